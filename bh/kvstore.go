@@ -0,0 +1,94 @@
+package bh
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrKeyNotFound is returned by KVStore.Get when key does not exist.
+var ErrKeyNotFound = errors.New("bh: key not found in registery")
+
+// KVPair represents a single key/value entry returned from a KVStore,
+// together with the index the backend uses for optimistic concurrency.
+type KVPair struct {
+	Key       string
+	Value     []byte
+	LastIndex uint64
+}
+
+// LockOptions configures the lock returned by KVStore.NewLock.
+type LockOptions struct {
+	// Value is stored alongside the lock so that other clients can tell who
+	// is holding it.
+	Value []byte
+	// TTL is how long the lock is held for in the absence of a renewal. Zero
+	// keeps the backend's default session TTL, so the lock still expires if
+	// its holder stops renewing it.
+	TTL time.Duration
+}
+
+// Locker is a distributed mutual exclusion primitive backed by a KVStore.
+type Locker interface {
+	// Lock blocks until the lock is acquired or stopCh is closed. The
+	// returned channel is closed if the lock is subsequently lost (e.g. the
+	// session backing it expires).
+	Lock(stopCh chan struct{}) (<-chan struct{}, error)
+	Unlock() error
+}
+
+// KVStore is the minimal coordination-service abstraction that registery is
+// built on top of. It is modeled on the docker/libkv store.Store interface
+// used by stolon, so that beehive's hive membership and app locking do not
+// depend on any single coordination service. HiveConfig.RegType selects the
+// concrete implementation (etcd, Consul, or ZooKeeper) that
+// connectToRegistery wires up.
+type KVStore interface {
+	// Put writes key/value, refreshing ttl if the key already exists. ttl of
+	// zero means the key never expires on its own. The Consul and ZooKeeper
+	// backends have no per-key expiry and ignore ttl.
+	Put(key string, value []byte, ttl time.Duration) error
+	// Get returns the current value of key, or ErrKeyNotFound if it is
+	// absent.
+	Get(key string) (*KVPair, error)
+	// Delete removes key.
+	Delete(key string) error
+	// Watch streams every subsequent value of key until stopCh is closed.
+	Watch(key string, stopCh chan struct{}) (<-chan *KVPair, error)
+	// WatchTree streams the full set of pairs under dir every time any of
+	// them changes, until stopCh is closed.
+	WatchTree(dir string, stopCh chan struct{}) (<-chan []*KVPair, error)
+	// AtomicPut writes key/value iff its current state matches previous
+	// (previous of nil means "key must not exist"). ttl is handled as in
+	// Put.
+	AtomicPut(key string, value []byte, previous *KVPair, ttl time.Duration) (bool, *KVPair, error)
+	// AtomicDelete removes key iff its current state matches previous.
+	AtomicDelete(key string, previous *KVPair) (bool, error)
+	// NewLock creates (but does not acquire) a Locker for key.
+	NewLock(key string, options *LockOptions) (Locker, error)
+	// Close releases any resources (connections, sessions) held by the
+	// store.
+	Close()
+}
+
+// Leaser is implemented by KVStore backends that can keep a key alive with
+// a server-managed heartbeat (e.g. an etcd lease), so registery does not
+// need to re-Put a hive's entry on a timer of its own. Backends without a
+// native lease primitive simply don't implement Leaser, and registery
+// falls back to polling Put instead.
+type Leaser interface {
+	// PutWithKeepAlive writes key/value bound to a ttl lease and keeps
+	// renewing it in the background until stopCh is closed. The returned
+	// channel is closed if the lease is lost before stopCh closes (e.g. the
+	// keepalive stream breaks), so the caller can react to the loss instead
+	// of silently running with an expired entry.
+	PutWithKeepAlive(key string, value []byte, ttl time.Duration, stopCh chan struct{}) (<-chan struct{}, error)
+}
+
+// Transactor is implemented by KVStore backends that can write several keys
+// atomically. registery uses it, when available, so that a multi-key
+// MapSet is stored as a single transaction instead of one Put per key that
+// could leave the registry torn if the client dies mid-loop.
+type Transactor interface {
+	// PutAll writes every pair in kvs in a single atomic transaction.
+	PutAll(kvs []KVPair, ttl time.Duration) error
+}
@@ -0,0 +1,209 @@
+package bh
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+const (
+	// PlaceRoundRobin, PlaceConsistentHash, and PlaceLeastLoaded are the
+	// valid values of HiveConfig.RegPlacement and of the per-app overrides
+	// in HiveConfig.RegAppPlacement. PlaceRoundRobin is used when neither is
+	// set.
+	PlaceRoundRobin     = "round-robin"
+	PlaceConsistentHash = "consistent-hash"
+	PlaceLeastLoaded    = "least-loaded"
+)
+
+// PlacementStrategy decides which hive should own a MapSet that has no
+// existing owner, so a new map-set does not always resolve to whichever
+// hive happened to call storeOrGet first. Callers query it via
+// registery.PlaceApp before creating the bee that will own ms.
+type PlacementStrategy interface {
+	// Place picks one of hives (the hives currently known to be alive) for
+	// app's ms.
+	Place(app AppName, ms MapSet, hives []HiveID) (HiveID, error)
+}
+
+var errNoHives = errors.New("registery: no hives available for placement")
+
+// placementFor resolves the PlacementStrategy configured for app, falling
+// back to HiveConfig.RegPlacement and then PlaceRoundRobin.
+func (g *registery) placementFor(app AppName) PlacementStrategy {
+	name := g.hive.config.RegPlacement
+	if p, ok := g.hive.config.RegAppPlacement[app]; ok {
+		name = p
+	}
+
+	switch name {
+	case PlaceConsistentHash:
+		return consistentHashPlacement{}
+	case PlaceLeastLoaded:
+		return leastLoadedPlacement{g}
+	default:
+		return roundRobinPlacement{g}
+	}
+}
+
+// PlaceApp consults the PlacementStrategy configured for app to decide
+// which hive should own a MapSet that has no existing owner.
+func (g *registery) PlaceApp(app AppName, ms MapSet) (HiveID, error) {
+	hives, err := g.listHives()
+	if err != nil {
+		return "", err
+	}
+	return g.placementFor(app).Place(app, ms, hives)
+}
+
+// listHives returns the HiveIDs currently registered in the hive
+// directory. It is the same data watchHives streams, taken as a one-shot
+// snapshot for PlacementStrategy implementations.
+func (g *registery) listHives() ([]HiveID, error) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	treeCh, err := g.WatchTree(g.hivePath(), stopCh)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs, ok := <-treeCh
+	if !ok {
+		return nil, errors.New("registery: hive directory watch closed immediately")
+	}
+
+	hives := make([]HiveID, len(pairs))
+	for i, p := range pairs {
+		hives[i] = g.hiveIDFromPath(p.Key)
+	}
+	return hives, nil
+}
+
+// roundRobinPlacement cycles through the live hives using a shared counter
+// stored in the registry, so repeated placements for an app spread evenly
+// across the cluster instead of piling onto whichever hive wins the race.
+type roundRobinPlacement struct {
+	g *registery
+}
+
+func (p roundRobinPlacement) Place(app AppName, ms MapSet, hives []HiveID) (HiveID, error) {
+	if len(hives) == 0 {
+		return "", errNoHives
+	}
+	sort.Slice(hives, func(i, j int) bool { return hives[i] < hives[j] })
+
+	k := p.g.appPath(string(app), "__rr__")
+	for {
+		cur, err := p.g.Get(k)
+		if err != nil && err != ErrKeyNotFound {
+			return "", err
+		}
+
+		var idx uint64
+		if cur != nil {
+			idx, _ = strconv.ParseUint(string(cur.Value), 10, 64)
+		}
+
+		next := []byte(strconv.FormatUint(idx+1, 10))
+		ok, _, err := p.g.AtomicPut(k, next, cur, 0)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return hives[idx%uint64(len(hives))], nil
+		}
+	}
+}
+
+// consistentHashReplicas is the number of points each hive gets on the
+// consistentHashPlacement ring. More replicas spread a hive's share of the
+// keyspace more evenly at the cost of a larger ring to search.
+const consistentHashReplicas = 100
+
+// consistentHashPlacement hashes app and ms's keys onto a ring of points,
+// each hive owning consistentHashReplicas of them, and picks the first
+// point at or after the key's hash. Unlike a plain hash%len(hives), adding
+// or removing a hive only remaps the keys that land in that hive's arcs of
+// the ring, not nearly every key in the cluster.
+type consistentHashPlacement struct{}
+
+func (consistentHashPlacement) Place(app AppName, ms MapSet, hives []HiveID) (HiveID, error) {
+	if len(hives) == 0 {
+		return "", errNoHives
+	}
+
+	type ringPoint struct {
+		hash uint32
+		hive HiveID
+	}
+	ring := make([]ringPoint, 0, len(hives)*consistentHashReplicas)
+	for _, id := range hives {
+		for r := 0; r < consistentHashReplicas; r++ {
+			h := fnv.New32a()
+			h.Write([]byte(id))
+			h.Write([]byte(strconv.Itoa(r)))
+			ring = append(ring, ringPoint{hash: h.Sum32(), hive: id})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	h := fnv.New32a()
+	h.Write([]byte(app))
+	for _, dk := range ms {
+		h.Write([]byte(dk.Dict))
+		h.Write([]byte(dk.Key))
+	}
+	key := h.Sum32()
+
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= key })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].hive, nil
+}
+
+// leastLoadedPlacement picks the hive with the lowest most-recently
+// reported load (see registery.ReportLoad), for warm-standby placement
+// instead of a fixed rotation or hash.
+type leastLoadedPlacement struct {
+	g *registery
+}
+
+func (p leastLoadedPlacement) Place(app AppName, ms MapSet, hives []HiveID) (HiveID, error) {
+	if len(hives) == 0 {
+		return "", errNoHives
+	}
+
+	best := hives[0]
+	bestLoad := p.g.hiveLoad(best)
+	for _, id := range hives[1:] {
+		if l := p.g.hiveLoad(id); l < bestLoad {
+			best, bestLoad = id, l
+		}
+	}
+	return best, nil
+}
+
+// hiveLoad returns id's most recently reported load, or 0 if it has never
+// reported one.
+func (g *registery) hiveLoad(id HiveID) float64 {
+	res, err := g.Get(g.loadPath(string(id)))
+	if err != nil {
+		return 0
+	}
+	l, _ := strconv.ParseFloat(string(res.Value), 64)
+	return l
+}
+
+// ReportLoad publishes this hive's current load so PlaceLeastLoaded can
+// balance new MapSets across the cluster. The hive is responsible for
+// calling this periodically; registery does not schedule it on its own.
+// Load entries live under loadPath rather than hivePath so they are never
+// picked up as a phantom hive by watchHives/listHives.
+func (g *registery) ReportLoad(load float64) error {
+	k := g.loadPath(string(g.hive.ID()))
+	v := []byte(strconv.FormatFloat(load, 'f', -1, 64))
+	return g.Put(k, v, 0)
+}
@@ -2,13 +2,13 @@ package bh
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
+	"math/rand"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/coreos/go-etcd/etcd"
 	"github.com/golang/glog"
 )
 
@@ -24,27 +24,170 @@ type HiveLeft struct {
 	HiveID HiveID // The ID of the hive.
 }
 
+// RegistryDisconnected is emitted when this hive can no longer reach the
+// registry after exhausting its retry policy. Apps that depend on
+// coordination (locks, placement) should treat this as a signal to pause
+// until RegistryReconnected follows.
+type RegistryDisconnected struct{}
+
+// RegistryReconnected is emitted once the registry becomes reachable again
+// after a RegistryDisconnected.
+type RegistryReconnected struct{}
+
+// AppLeaderChanged is emitted whenever the hive elected leader for an app
+// changes, including the initial election. See registery.ElectLeader.
+type AppLeaderChanged struct {
+	AppName AppName
+	HiveID  HiveID
+}
+
 const (
 	regPrefix    = "beehive"
 	regAppDir    = "apps"
 	regHiveDir   = "hives"
+	regLoadDir   = "load"
 	regAppTTL    = 0
 	regHiveTTL   = 60
-	expireAction = "expire"
 	lockFileName = "__lock__"
+
+	// RegTypeEtcd, RegTypeConsul, and RegTypeZk are the valid values of
+	// HiveConfig.RegType. RegTypeEtcd is used when RegType is left empty.
+	RegTypeEtcd   = "etcd"
+	RegTypeConsul = "consul"
+	RegTypeZk     = "zk"
 )
 
+// registery implements Registry on top of a KVStore. It owns no
+// backend-specific knowledge: hive membership, app locking, and bee
+// placement are all expressed in terms of the KVStore interface, so the
+// same code runs unmodified against etcd, Consul, or ZooKeeper.
 type registery struct {
-	*etcd.Client
-	hive          *hive
-	prefix        string
-	hiveDir       string
-	hiveTTL       uint64
-	appDir        string
-	appTTL        uint64
-	watchCancelCh chan bool
-	watchJoinCh   chan bool
-	ttlCancelCh   chan chan bool
+	KVStore
+	hive        *hive
+	prefix      string
+	hiveDir     string
+	hiveTTL     uint64
+	appDir      string
+	appTTL      uint64
+	loadDir     string
+	watchStopCh chan struct{}
+	watchJoinCh chan bool
+	ttlCancelCh chan chan bool
+	leaseStopCh chan struct{}
+	retry       retryPolicy
+	locksMu     *sync.Mutex
+	locks       map[string]Locker
+}
+
+var _ Registry = (*registery)(nil)
+
+func (g *registery) RegisterHive() error {
+	return g.registerHive()
+}
+
+func (g *registery) WatchHives() {
+	g.watchHives()
+}
+
+func (g *registery) LockApp(id BeeID) error {
+	return g.lockApp(id)
+}
+
+func (g *registery) UnlockApp(id BeeID) error {
+	return g.unlockApp(id)
+}
+
+func (g *registery) Set(id BeeID, ms MapSet) (beeRegVal, error) {
+	return g.set(id, ms)
+}
+
+func (g *registery) StoreOrGet(id BeeID, ms MapSet) (beeRegVal, error) {
+	return g.storeOrGet(id, ms)
+}
+
+const (
+	defaultRetryBaseDelay = 500 * time.Millisecond
+	defaultRetryMaxDelay  = 30 * time.Second
+	defaultRetryJitter    = 0.2
+)
+
+// retryPolicy is the backoff schedule used for registry operations that can
+// fail transiently (a network blip, a leader election on the coordination
+// service), configured via HiveConfig.RegRetry*. retryPolicyFromConfig
+// replaces zero delays and a zero jitter with the defaults above; a zero
+// MaxAttempts retries forever.
+type retryPolicy struct {
+	// MaxAttempts bounds how many times retry calls op before giving up.
+	// Zero means retry forever.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Jitter is the fraction of the current delay added as randomized
+	// slack, to avoid every hive retrying in lockstep.
+	Jitter float64
+}
+
+func retryPolicyFromConfig(cfg HiveConfig) retryPolicy {
+	p := retryPolicy{
+		MaxAttempts: cfg.RegRetryMaxAttempts,
+		BaseDelay:   cfg.RegRetryBaseDelay,
+		MaxDelay:    cfg.RegRetryMaxDelay,
+		Jitter:      cfg.RegRetryJitter,
+	}
+	if p.BaseDelay == 0 {
+		p.BaseDelay = defaultRetryBaseDelay
+	}
+	if p.MaxDelay == 0 {
+		p.MaxDelay = defaultRetryMaxDelay
+	}
+	if p.Jitter == 0 {
+		p.Jitter = defaultRetryJitter
+	}
+	return p
+}
+
+// retry calls op until it succeeds or MaxAttempts is spent, sleeping an
+// exponentially growing, jittered delay in between.
+func (p retryPolicy) retry(op func() error) error {
+	delay := p.BaseDelay
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return err
+		}
+
+		sleep := delay
+		if p.Jitter > 0 {
+			sleep += time.Duration(rand.Float64() * p.Jitter * float64(delay))
+		}
+		time.Sleep(sleep)
+
+		delay *= 2
+		if delay > p.MaxDelay {
+			delay = p.MaxDelay
+		}
+	}
+}
+
+// newKVStore dials the coordination service selected by cfg.RegType,
+// defaulting to etcd when RegType is empty. cfg.RegTLS is fully honored
+// only for RegTypeEtcd: RegTypeConsul only carries over
+// InsecureSkipVerify, and RegTypeZk ignores it entirely and always dials
+// in plaintext (see newConsulKVStore and newZkKVStore for why).
+func newKVStore(cfg HiveConfig) (KVStore, error) {
+	switch cfg.RegType {
+	case "", RegTypeEtcd:
+		return newEtcdKVStore(cfg)
+	case RegTypeConsul:
+		return newConsulKVStore(cfg)
+	case RegTypeZk:
+		return newZkKVStore(cfg)
+	default:
+		return nil, fmt.Errorf("registery: unknown RegType %q", cfg.RegType)
+	}
 }
 
 func (h *hive) connectToRegistery() {
@@ -52,135 +195,474 @@ func (h *hive) connectToRegistery() {
 		return
 	}
 
-	// TODO(soheil): Add TLS registery.
+	kv, err := newKVStore(h.config)
+	if err != nil {
+		glog.Fatalf("Cannot connect to registery nodes: %v", err)
+	}
+
 	h.registery = registery{
-		Client:  etcd.NewClient(h.config.RegAddrs),
+		KVStore: kv,
 		hive:    h,
 		prefix:  regPrefix,
 		hiveDir: regHiveDir,
 		hiveTTL: regHiveTTL,
 		appDir:  regAppDir,
 		appTTL:  regAppTTL,
-	}
-
-	if ok := h.registery.SyncCluster(); !ok {
-		glog.Fatalf("Cannot connect to registery nodes: %s", h.config.RegAddrs)
+		loadDir: regLoadDir,
+		retry:   retryPolicyFromConfig(h.config),
+		locksMu: &sync.Mutex{},
+		locks:   make(map[string]Locker),
 	}
 
 	h.RegisterMsg(HiveJoined{})
 	h.RegisterMsg(HiveLeft{})
-	h.registery.registerHive()
+	h.RegisterMsg(RegistryDisconnected{})
+	h.RegisterMsg(RegistryReconnected{})
+	h.RegisterMsg(AppLeaderChanged{})
+
+	if err := h.registery.retry.retry(h.registery.registerHive); err != nil {
+		glog.Errorf("Cannot register hive entry in the registery: %v", err)
+		h.Emit(RegistryDisconnected{})
+	}
 	h.registery.startPollers()
 }
 
-func (g *registery) disconnect() {
+func (g *registery) disconnect() error {
 	if !g.connected() {
-		return
+		return nil
 	}
 
-	g.watchCancelCh <- true
+	close(g.watchStopCh)
 	<-g.watchJoinCh
 
-	cancelRes := make(chan bool)
-	g.ttlCancelCh <- cancelRes
-	<-cancelRes
+	if g.leaseStopCh != nil {
+		close(g.leaseStopCh)
+	} else {
+		cancelRes := make(chan bool)
+		g.ttlCancelCh <- cancelRes
+		<-cancelRes
+	}
 
-	g.unregisterHive()
+	err := g.unregisterHive()
+	g.Close()
+	return err
 }
 
 func (g registery) connected() bool {
-	return g.Client != nil
+	return g.KVStore != nil
 }
 
-func (g *registery) hiveRegKeyVal() (string, string) {
-	v := string(g.hive.ID())
-	return g.hivePath(v), v
+// hiveRegEntry is the value stored at a hive's registry key. When
+// HiveConfig.RegAuthKey is set, Token is a signed hiveClaims proving that
+// the entry really was written by HiveID, so a rogue process cannot
+// register a fake HiveID by writing to the hive directory directly.
+type hiveRegEntry struct {
+	HiveID HiveID `json:"hive_id"`
+	Token  string `json:"token,omitempty"`
 }
 
-func (g *registery) registerHive() {
-	k, v := g.hiveRegKeyVal()
-	if _, err := g.Create(k, v, g.hiveTTL); err != nil {
-		glog.Fatalf("Error in registering hive entry: %v", err)
+func (g *registery) hiveRegKeyVal() (string, []byte, error) {
+	id := g.hive.ID()
+	entry := hiveRegEntry{HiveID: id}
+
+	if len(g.hive.config.RegAuthKey) != 0 {
+		token, err := signHiveToken(id, g.hive.config.RegCapabilities, g.hive.config.RegAuthKey)
+		if err != nil {
+			return "", nil, err
+		}
+		entry.Token = token
 	}
+
+	v, err := json.Marshal(entry)
+	if err != nil {
+		return "", nil, err
+	}
+	return g.hivePath(string(id)), v, nil
 }
 
-func (g *registery) unregisterHive() {
-	k, _ := g.hiveRegKeyVal()
-	if _, err := g.Delete(k, false); err != nil {
-		glog.Fatalf("Error in unregistering hive entry: %v", err)
+// registerHive announces this hive's entry. When the backend is a Leaser
+// (e.g. etcd), the entry is bound to a lease that is kept alive in the
+// background, so it disappears on its own if the hive dies or is
+// partitioned from the registry; otherwise it falls back to the polling
+// updateTTL loop started by startPollers, which re-signs hiveRegEntry.Token
+// on every Put. On the Leaser path the token is only ever signed once, at
+// initial registration (and again on any reconnect, which calls
+// registerHive afresh): a hive that stays up and keeps its lease alive for
+// longer than hiveTokenTTL will have other hives start rejecting its
+// HiveJoined entry as an expired token even though it is still healthy.
+// Closing that gap requires re-Put-ing the value without disturbing the
+// lease the Leaser is keeping alive, which the KVStore interface doesn't
+// expose a way to do yet; tracked as a known gap rather than worked around
+// here.
+func (g *registery) registerHive() error {
+	k, v, err := g.hiveRegKeyVal()
+	if err != nil {
+		return err
 	}
+	ttl := time.Duration(g.hiveTTL) * time.Second
+
+	if l, ok := g.KVStore.(Leaser); ok {
+		g.leaseStopCh = make(chan struct{})
+		lost, err := l.PutWithKeepAlive(k, v, ttl, g.leaseStopCh)
+		if err != nil {
+			return err
+		}
+		go g.watchLease(lost)
+		return nil
+	}
+
+	return g.Put(k, v, ttl)
+}
+
+// watchLease waits for a Leaser-backed hive entry to be lost (e.g. the
+// keepalive stream breaks), emits RegistryDisconnected, and keeps
+// re-registering with backoff until it succeeds, emitting
+// RegistryReconnected once it does. It does nothing if g.leaseStopCh closes
+// first, since that means disconnect() is tearing the hive down on purpose.
+func (g *registery) watchLease(lost <-chan struct{}) {
+	select {
+	case <-g.leaseStopCh:
+		return
+	case <-lost:
+	}
+
+	glog.Errorf("Lost hive %s's lease in the registery", g.hive.ID())
+	g.hive.Emit(RegistryDisconnected{})
+
+	if err := g.retry.retry(g.registerHive); err != nil {
+		glog.Errorf("Giving up on re-registering hive %s in the registery: %v", g.hive.ID(), err)
+		return
+	}
+	g.hive.Emit(RegistryReconnected{})
+}
+
+func (g *registery) unregisterHive() error {
+	k, _, err := g.hiveRegKeyVal()
+	if err != nil {
+		return err
+	}
+	return g.Delete(k)
 }
 
 func (g *registery) startPollers() {
-	g.ttlCancelCh = make(chan chan bool)
-	go g.updateTTL()
+	if _, ok := g.KVStore.(Leaser); !ok {
+		g.ttlCancelCh = make(chan chan bool)
+		go g.updateTTL()
+	}
 
-	g.watchCancelCh = make(chan bool)
+	g.watchStopCh = make(chan struct{})
 	g.watchJoinCh = make(chan bool)
 	go g.watchHives()
 }
 
+// updateTTL periodically refreshes the hive's entry for backends without a
+// native lease. A failed refresh no longer kills the process: it is retried
+// with backoff, and RegistryDisconnected/RegistryReconnected bracket any
+// stretch where the registry was unreachable.
 func (g *registery) updateTTL() {
 	waitTimeout := g.hiveTTL / 2
 	if waitTimeout == 0 {
 		waitTimeout = 1
 	}
 
+	disconnected := false
 	for {
 		select {
 		case ch := <-g.ttlCancelCh:
 			ch <- true
 			return
 		case <-time.After(time.Duration(waitTimeout) * time.Second):
-			k, v := g.hiveRegKeyVal()
-			if _, err := g.Update(k, v, g.hiveTTL); err != nil {
-				glog.Fatalf("Error in updating hive entry in the registery: %v", err)
+			k, v, err := g.hiveRegKeyVal()
+			ttl := time.Duration(g.hiveTTL) * time.Second
+			if err == nil {
+				err = g.retry.retry(func() error {
+					return g.Put(k, v, ttl)
+				})
+			}
+			if err != nil {
+				glog.Errorf("Error in updating hive entry in the registery: %v", err)
+				if !disconnected {
+					disconnected = true
+					g.hive.Emit(RegistryDisconnected{})
+				}
+				continue
+			}
+
+			if disconnected {
+				disconnected = false
+				g.hive.Emit(RegistryReconnected{})
 			}
 			glog.V(1).Infof("Hive %s's TTL updated in registery", g.hive.ID())
 		}
 	}
 }
 
+// watchHives re-establishes its WatchTree whenever the registry drops the
+// connection, waiting retry.BaseDelay between attempts and never giving
+// up, so a temporary disconnect surfaces as
+// RegistryDisconnected/RegistryReconnected instead of silently missing
+// HiveJoined/HiveLeft events or crashing the process.
 func (g *registery) watchHives() {
-	res, err := g.Get(g.hivePath(), false, true)
-	if err != nil {
-		glog.Fatalf("Cannot find the hive directory: %v", err)
-	}
-
-	for _, n := range res.Node.Nodes {
-		g.hive.Emit(HiveJoined{g.hiveIDFromPath(n.Key)})
-	}
-
-	resCh := make(chan *etcd.Response)
-	joinCh := make(chan bool)
-	go func() {
-		g.Watch(g.hivePath(), 0, true, resCh, g.watchCancelCh)
-		joinCh <- true
-	}()
+	joined := map[HiveID]bool{}
+	disconnected := false
 
 	for {
 		select {
-		case <-joinCh:
+		case <-g.watchStopCh:
 			g.watchJoinCh <- true
 			return
-		case res := <-resCh:
-			if res == nil {
-				continue
+		default:
+		}
+
+		treeCh, err := g.WatchTree(g.hivePath(), g.watchStopCh)
+		if err != nil {
+			glog.Errorf("Cannot watch the hive directory: %v", err)
+			if !disconnected {
+				disconnected = true
+				g.hive.Emit(RegistryDisconnected{})
 			}
+			time.Sleep(g.retry.BaseDelay)
+			continue
+		}
 
-			switch res.Action {
-			case "create":
-				if res.PrevNode == nil {
-					g.hive.Emit(HiveJoined{g.hiveIDFromPath(res.Node.Key)})
+		if disconnected {
+			disconnected = false
+			g.hive.Emit(RegistryReconnected{})
+		}
+
+		for pairs := range treeCh {
+			seen := map[HiveID]bool{}
+			for _, p := range pairs {
+				id, ok := g.verifyHiveEntry(p)
+				if !ok {
+					glog.Errorf("Rejecting hive entry with invalid signature: %s", p.Key)
+					continue
+				}
+				seen[id] = true
+				if !joined[id] {
+					g.hive.Emit(HiveJoined{id})
 				}
-			case "delete":
-				if res.PrevNode != nil {
-					g.hive.Emit(HiveLeft{g.hiveIDFromPath(res.Node.Key)})
+			}
+
+			for id := range joined {
+				if !seen[id] {
+					g.hive.Emit(HiveLeft{id})
 				}
-			default:
-				glog.V(2).Infof("Received an update from registery: %+v", *res)
 			}
+
+			joined = seen
 		}
+
+		select {
+		case <-g.watchStopCh:
+			g.watchJoinCh <- true
+			return
+		default:
+		}
+
+		// treeCh closed without g.watchStopCh closing it: the backend lost
+		// its subscription (e.g. the connection dropped after WatchTree
+		// returned successfully). Treat it the same as a failed (re)Watch.
+		glog.Errorf("Hive directory watch for %s closed unexpectedly", g.hivePath())
+		if !disconnected {
+			disconnected = true
+			g.hive.Emit(RegistryDisconnected{})
+		}
+		time.Sleep(g.retry.BaseDelay)
+	}
+}
+
+// verifyHiveEntry checks a hive directory entry against
+// HiveConfig.RegAuthKey, if one is configured, so that a HiveJoined is only
+// emitted for entries this hive can prove were written by the HiveID they
+// claim.
+func (g *registery) verifyHiveEntry(p *KVPair) (HiveID, bool) {
+	id := g.hiveIDFromPath(p.Key)
+
+	key := g.hive.config.RegAuthKey
+	if len(key) == 0 {
+		return id, true
+	}
+
+	var entry hiveRegEntry
+	if err := json.Unmarshal(p.Value, &entry); err != nil || entry.HiveID != id {
+		return id, false
+	}
+
+	if _, err := verifyHiveToken(entry.Token, id, key); err != nil {
+		return id, false
+	}
+
+	return id, true
+}
+
+// signedEntry wraps an arbitrary registry value with a signature proving
+// which HiveID wrote it, the same scheme hiveRegEntry uses for hive
+// directory entries. ElectLeader, campaignLeader, and watchLeader verify it
+// on the leader key, so an unsigned value written there directly is never
+// taken for an app's leader. lockApp signs the app lock's value the same
+// way, but only for attribution: nothing reads it back (see lockApp).
+type signedEntry struct {
+	HiveID HiveID `json:"hive_id"`
+	Value  []byte `json:"value"`
+	Token  string `json:"token,omitempty"`
+}
+
+// signEntry wraps value as having been written by id, signing it with
+// HiveConfig.RegAuthKey when one is configured.
+func (g *registery) signEntry(id HiveID, value []byte) ([]byte, error) {
+	entry := signedEntry{HiveID: id, Value: value}
+
+	if len(g.hive.config.RegAuthKey) != 0 {
+		token, err := signHiveToken(id, g.hive.config.RegCapabilities, g.hive.config.RegAuthKey)
+		if err != nil {
+			return nil, err
+		}
+		entry.Token = token
+	}
+
+	return json.Marshal(entry)
+}
+
+// verifyEntry checks data against HiveConfig.RegAuthKey, if one is
+// configured, and returns the value it wraps.
+func (g *registery) verifyEntry(data []byte) ([]byte, bool) {
+	var entry signedEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+
+	key := g.hive.config.RegAuthKey
+	if len(key) == 0 {
+		return entry.Value, true
+	}
+
+	if _, err := verifyHiveToken(entry.Token, entry.HiveID, key); err != nil {
+		return nil, false
+	}
+
+	return entry.Value, true
+}
+
+// leaderEmitTracker remembers the last HiveID that AppLeaderChanged was
+// emitted for, so campaignLeader's periodic TTL refresh of an unchanged
+// leader entry and watchLeader's watch event for that same refresh don't
+// each produce a spurious event — only an actual change in who holds the
+// leader entry does.
+type leaderEmitTracker struct {
+	mu   sync.Mutex
+	last HiveID
+}
+
+func (t *leaderEmitTracker) emitIfChanged(g *registery, app AppName, id HiveID) {
+	t.mu.Lock()
+	changed := t.last != id
+	t.last = id
+	t.mu.Unlock()
+
+	if changed {
+		g.hive.Emit(AppLeaderChanged{AppName: app, HiveID: id})
+	}
+}
+
+// ElectLeader designates this hive as a candidate for leadership of app and
+// returns the HiveID currently holding (or about to hold) the leader
+// entry, an ephemeral key at appPath(app, "__leader__") whose value is a
+// signedEntry carrying the holder's HiveID. The returned cancel func stops
+// this hive's candidacy; AppLeaderChanged is emitted, on every hive
+// watching, whenever the leader's entry changes, including failover to
+// another candidate, but not on every TTL refresh of an unchanged leader.
+func (g *registery) ElectLeader(app AppName) (HiveID, func(), error) {
+	k := g.appPath(string(app), "__leader__")
+	id := g.hive.ID()
+
+	var cur HiveID
+	if p, err := g.Get(k); err == nil {
+		if v, ok := g.verifyEntry(p.Value); ok {
+			cur = HiveID(v)
+		}
+	}
+
+	leader := cur
+	if leader == "" {
+		leader = id
+	}
+
+	emitted := &leaderEmitTracker{last: cur}
+
+	stopCh := make(chan struct{})
+	go g.campaignLeader(app, k, id, emitted, stopCh)
+	go g.watchLeader(app, k, emitted, stopCh)
+
+	return leader, func() { close(stopCh) }, nil
+}
+
+// campaignLeader tries to claim k for id, refreshing it like a hive's own
+// TTL entry so that a dead leader's claim expires and another candidate can
+// take over. The signed value is re-signed on every refresh (not just
+// once at the start) so its token's expiry keeps advancing for as long as
+// this hive keeps winning the campaign.
+func (g *registery) campaignLeader(app AppName, k string, id HiveID, emitted *leaderEmitTracker, stopCh chan struct{}) {
+	ttl := time.Duration(g.hiveTTL) * time.Second
+	waitTimeout := g.hiveTTL / 2
+	if waitTimeout == 0 {
+		waitTimeout = 1
+	}
+
+	sign := func() ([]byte, error) { return g.signEntry(id, []byte(id)) }
+
+	isHeldByMe := func(cur *KVPair) bool {
+		v, ok := g.verifyEntry(cur.Value)
+		return ok && HiveID(v) == id
+	}
+
+	for {
+		sv, err := sign()
+		if err != nil {
+			glog.Errorf("Cannot sign leader entry for app %v: %v", app, err)
+			return
+		}
+
+		if ok, _, err := g.AtomicPut(k, sv, nil, ttl); err == nil && ok {
+			emitted.emitIfChanged(g, app, id)
+		}
+
+		select {
+		case <-stopCh:
+			if cur, err := g.Get(k); err == nil && isHeldByMe(cur) {
+				g.AtomicDelete(k, cur)
+			}
+			return
+		case <-time.After(time.Duration(waitTimeout) * time.Second):
+			if cur, err := g.Get(k); err == nil && isHeldByMe(cur) {
+				// Refreshing our own unchanged claim, not a new election:
+				// emitted.emitIfChanged would see the same id and skip it
+				// anyway, but AtomicPut here is a TTL renewal, so don't
+				// bother calling it. sv is re-signed each loop iteration
+				// (above) so this renewal carries a fresh expiry too.
+				g.AtomicPut(k, sv, cur, ttl)
+			}
+		}
+	}
+}
+
+// watchLeader emits AppLeaderChanged whenever k's value (the current
+// leader's signed HiveID) changes, rejecting any entry whose signature
+// does not verify so a rogue write to the leader key cannot be mistaken
+// for a real failover.
+func (g *registery) watchLeader(app AppName, k string, emitted *leaderEmitTracker, stopCh chan struct{}) {
+	ch, err := g.Watch(k, stopCh)
+	if err != nil {
+		glog.Errorf("Cannot watch leader entry for app %v: %v", app, err)
+		return
+	}
+	for p := range ch {
+		v, ok := g.verifyEntry(p.Value)
+		if !ok {
+			glog.Errorf("Rejecting leader entry with invalid signature for app %v: %s", app, p.Key)
+			continue
+		}
+		emitted.emitIfChanged(g, app, HiveID(v))
 	}
 }
 
@@ -193,13 +675,13 @@ func (v *beeRegVal) Eq(that *beeRegVal) bool {
 	return v.HiveID == that.HiveID && v.BeeID == that.BeeID
 }
 
-func unmarshallRegVal(d string) (beeRegVal, error) {
+func unmarshallRegVal(d []byte) (beeRegVal, error) {
 	var v beeRegVal
-	err := json.Unmarshal([]byte(d), &v)
+	err := json.Unmarshal(d, &v)
 	return v, err
 }
 
-func unmarshallRegValOrFail(d string) beeRegVal {
+func unmarshallRegValOrFail(d []byte) beeRegVal {
 	v, err := unmarshallRegVal(d)
 	if err != nil {
 		glog.Fatalf("Cannot unmarshall registery value %v: %v", d, err)
@@ -207,12 +689,11 @@ func unmarshallRegValOrFail(d string) beeRegVal {
 	return v
 }
 
-func marshallRegVal(v beeRegVal) (string, error) {
-	b, err := json.Marshal(v)
-	return string(b), err
+func marshallRegVal(v beeRegVal) ([]byte, error) {
+	return json.Marshal(v)
 }
 
-func marshallRegValOrFail(v beeRegVal) string {
+func marshallRegValOrFail(v beeRegVal) []byte {
 	d, err := marshallRegVal(v)
 	if err != nil {
 		glog.Fatalf("Cannot marshall registery value %v: %v", v, err)
@@ -232,105 +713,141 @@ func (g registery) hivePath(elem ...string) string {
 	return g.prefix + "/" + g.hiveDir + "/" + strings.Join(elem, "/")
 }
 
+// loadPath is the directory load reports live under (see
+// registery.ReportLoad), kept separate from hivePath so a hive's load entry
+// is never enumerated as a phantom membership entry by watchHives or
+// listHives.
+func (g registery) loadPath(elem ...string) string {
+	return g.prefix + "/" + g.loadDir + "/" + strings.Join(elem, "/")
+}
+
 func (g registery) hiveIDFromPath(path string) HiveID {
-	prefixLen := len(g.hivePath()) + 1
-	return HiveID(path[prefixLen:])
+	// hivePath() already ends in "/" (it joins no further elements), so the
+	// HiveID starts right after it; the etcd v3 client (unlike the old v2
+	// client) returns keys without a leading slash.
+	return HiveID(path[len(g.hivePath()):])
 }
 
+// lockApp acquires the app-wide lock for id via the backend's Locker (a
+// concurrency.Mutex bound to an etcd lease, for the default backend), so
+// the lock is released automatically if the holder's session expires
+// instead of lingering until someone notices and deletes it. The Locker is
+// kept in g.locks, keyed by the app's lock path, so unlockApp can release
+// the same lock instance rather than operating on a key the Locker never
+// actually writes. Exclusivity itself comes entirely from the backend's
+// locking primitive (the etcd session lease, a Consul session, a
+// ZooKeeper ephemeral-sequential node): that is what a rogue process would
+// have to go through, not a bare Put to appPath(...)/__lock__. The stored
+// value is signed like the leader entry purely so a human or tool
+// inspecting the lock can attribute it to the real holder; nothing in this
+// package reads it back to authorize anything.
 func (g registery) lockApp(id BeeID) error {
-	// TODO(soheil): For lock and unlock we can use etcd indices but
-	// v.Temp might be changed by the app. Check this and fix it if possible.
 	v := beeRegVal{
 		HiveID: id.HiveID,
 		BeeID:  id.ID,
 	}
 	k := g.appPath(string(id.AppName), lockFileName)
 
-	for {
-		_, err := g.Create(k, marshallRegValOrFail(v), g.appTTL)
-		if err == nil {
-			return nil
-		}
+	lv, err := g.signEntry(id.HiveID, marshallRegValOrFail(v))
+	if err != nil {
+		return err
+	}
 
-		_, err = g.Watch(k, 0, false, nil, nil)
-		if err != nil {
-			return err
-		}
+	l, err := g.NewLock(k, &LockOptions{Value: lv})
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.Lock(nil); err != nil {
+		return err
 	}
+
+	g.locksMu.Lock()
+	g.locks[k] = l
+	g.locksMu.Unlock()
+
+	return nil
 }
 
 func (g registery) unlockApp(id BeeID) error {
-	v := beeRegVal{
-		HiveID: id.HiveID,
-		BeeID:  id.ID,
-	}
 	k := g.appPath(string(id.AppName), lockFileName)
 
-	res, err := g.Get(k, false, false)
-	if err != nil {
-		return err
-	}
+	g.locksMu.Lock()
+	l, ok := g.locks[k]
+	delete(g.locks, k)
+	g.locksMu.Unlock()
 
-	tempV := unmarshallRegValOrFail(res.Node.Value)
-	if !v.Eq(&tempV) {
-		return errors.New(
-			fmt.Sprintf("Unlocking someone else's lock: %v, %v", v, tempV))
+	if !ok {
+		return fmt.Errorf("unlocking app %v: no lock held by this hive", id.AppName)
 	}
 
-	_, err = g.Delete(k, false)
-	if err != nil {
-		return err
+	return l.Unlock()
+}
+
+// putKeys writes every key in keys to value, atomically through Transactor
+// when the backend supports it, so a crash mid-write can't leave a MapSet
+// resolved to different bees on different keys.
+func (g registery) putKeys(keys []string, value []byte) error {
+	ttl := time.Duration(g.appTTL) * time.Second
+
+	if tx, ok := g.KVStore.(Transactor); ok {
+		pairs := make([]KVPair, len(keys))
+		for i, k := range keys {
+			pairs[i] = KVPair{Key: k, Value: value}
+		}
+		return tx.PutAll(pairs, ttl)
 	}
 
+	for _, k := range keys {
+		if err := g.Put(k, value, ttl); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (g registery) set(id BeeID, ms MapSet) beeRegVal {
-	err := g.lockApp(id)
-	if err != nil {
-		glog.Fatalf("Cannot lock app %v: %v", id, err)
+func (g registery) set(id BeeID, ms MapSet) (v beeRegVal, err error) {
+	if err = g.lockApp(id); err != nil {
+		return beeRegVal{}, fmt.Errorf("cannot lock app %v: %v", id, err)
 	}
 
 	defer func() {
-		err := g.unlockApp(id)
-		if err != nil {
-			glog.Fatalf("Cannot unlock app %v: %v", id, err)
+		if uerr := g.unlockApp(id); uerr != nil && err == nil {
+			err = fmt.Errorf("cannot unlock app %v: %v", id, uerr)
 		}
 	}()
 
 	sort.Sort(ms)
 
-	v := beeRegVal{
+	v = beeRegVal{
 		HiveID: id.HiveID,
 		BeeID:  id.ID,
 	}
 	mv := marshallRegValOrFail(v)
-	for _, dk := range ms {
-		k := g.appPath(string(id.AppName), string(dk.Dict), string(dk.Key))
-		_, err := g.Set(k, mv, g.appTTL)
-		if err != nil {
-			glog.Fatalf("Cannot set bee: %+v", k)
-		}
+	keys := make([]string, len(ms))
+	for i, dk := range ms {
+		keys[i] = g.appPath(string(id.AppName), string(dk.Dict), string(dk.Key))
 	}
-	return v
+	if err = g.putKeys(keys, mv); err != nil {
+		return beeRegVal{}, fmt.Errorf("cannot set bee %v: %v", id, err)
+	}
+	return v, nil
 }
 
-func (g registery) storeOrGet(id BeeID, ms MapSet) beeRegVal {
-	err := g.lockApp(id)
-	if err != nil {
-		glog.Fatalf("Cannot lock app %v: %v", id, err)
+func (g registery) storeOrGet(id BeeID, ms MapSet) (v beeRegVal, err error) {
+	if err = g.lockApp(id); err != nil {
+		return beeRegVal{}, fmt.Errorf("cannot lock app %v: %v", id, err)
 	}
 
 	defer func() {
-		err := g.unlockApp(id)
-		if err != nil {
-			glog.Fatalf("Cannot unlock app %v: %v", id, err)
+		if uerr := g.unlockApp(id); uerr != nil && err == nil {
+			err = fmt.Errorf("cannot unlock app %v: %v", id, uerr)
 		}
 	}()
 
 	sort.Sort(ms)
 
-	v := beeRegVal{
+	v = beeRegVal{
 		HiveID: id.HiveID,
 		BeeID:  id.ID,
 	}
@@ -338,29 +855,33 @@ func (g registery) storeOrGet(id BeeID, ms MapSet) beeRegVal {
 	validate := false
 	for _, dk := range ms {
 		k := g.appPath(string(id.AppName), string(dk.Dict), string(dk.Key))
-		res, err := g.Get(k, false, false)
-		if err != nil {
+		res, gerr := g.Get(k)
+		if gerr != nil {
 			continue
 		}
 
-		resV := unmarshallRegValOrFail(res.Node.Value)
+		resV := unmarshallRegValOrFail(res.Value)
 		if resV.Eq(&v) {
 			continue
 		}
 
 		if validate {
-			glog.Fatalf("Incosistencies for bee %v: %v, %v", id, v, resV)
+			return beeRegVal{}, fmt.Errorf(
+				"inconsistencies for bee %v: %v, %v", id, v, resV)
 		}
 
 		v = resV
-		mv = res.Node.Value
+		mv = res.Value
 		validate = true
 	}
 
-	for _, dk := range ms {
-		k := g.appPath(string(id.AppName), string(dk.Dict), string(dk.Key))
-		g.Create(k, mv, g.appTTL)
+	keys := make([]string, len(ms))
+	for i, dk := range ms {
+		keys[i] = g.appPath(string(id.AppName), string(dk.Dict), string(dk.Key))
+	}
+	if err = g.putKeys(keys, mv); err != nil {
+		return beeRegVal{}, fmt.Errorf("cannot store bee %v: %v", id, err)
 	}
 
-	return v
+	return v, nil
 }
@@ -0,0 +1,34 @@
+package bh
+
+// Registry is the coordination API that a hive uses to announce itself to
+// the rest of the cluster and to serialize access to app state. It is
+// implemented by registery on top of a KVStore, so the set of methods here
+// is deliberately beehive-specific (hives, apps, bees) rather than a raw
+// key/value API.
+type Registry interface {
+	// RegisterHive announces this hive to the cluster.
+	RegisterHive() error
+	// WatchHives emits HiveJoined and HiveLeft as hives come and go. It
+	// blocks until the registry is shut down; a lost connection to the
+	// coordination service is retried rather than ending the call.
+	WatchHives()
+	// LockApp blocks until id's app is exclusively locked by id.
+	LockApp(id BeeID) error
+	// UnlockApp releases a lock previously acquired by LockApp.
+	UnlockApp(id BeeID) error
+	// Set registers that every key in ms is now owned by id.
+	Set(id BeeID, ms MapSet) (beeRegVal, error)
+	// StoreOrGet registers ms as owned by id, unless some key in ms is
+	// already owned by another bee, in which case that bee's ownership wins
+	// and is returned.
+	StoreOrGet(id BeeID, ms MapSet) (beeRegVal, error)
+	// PlaceApp decides which hive should own a MapSet that has no existing
+	// owner, according to the PlacementStrategy configured for app.
+	PlaceApp(app AppName, ms MapSet) (HiveID, error)
+	// ElectLeader enters this hive into the leader election for app and
+	// returns the currently elected HiveID and a cancel func that withdraws
+	// this hive's candidacy.
+	ElectLeader(app AppName) (HiveID, func(), error)
+	// Close releases the registry's underlying KVStore.
+	Close()
+}
@@ -0,0 +1,66 @@
+package bh
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// hiveClaims are the JWT claims carried by the bearer token a hive presents
+// when it registers, proving it is who it claims to be and what it is
+// allowed to do.
+type hiveClaims struct {
+	jwt.StandardClaims
+	HiveID       HiveID   `json:"hive_id"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// hiveTokenTTL bounds how long a signed hive/lock/leader token stays
+// valid, so a token harvested off the wire or out of the registry (tokens
+// are stored in cleartext alongside the value they authenticate) cannot be
+// replayed indefinitely. Callers that hold a token for longer than this
+// are expected to re-sign and rewrite their entry before it lapses;
+// registerHive, lockApp, and campaignLeader all do, with the exception
+// noted on registerHive's Leaser path.
+const hiveTokenTTL = 10 * time.Minute
+
+// signHiveToken issues a bearer token for id, valid for hiveTokenTTL and
+// signed with key, carrying capabilities. key is HiveConfig.RegAuthKey, a
+// secret shared by every hive in the cluster.
+func signHiveToken(id HiveID, capabilities []string, key []byte) (string, error) {
+	now := time.Now()
+	claims := hiveClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   string(id),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(hiveTokenTTL).Unix(),
+		},
+		HiveID:       id,
+		Capabilities: capabilities,
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+}
+
+// verifyHiveToken checks that token was signed with key and asserts id,
+// returning the embedded claims (including capabilities) on success.
+func verifyHiveToken(token string, id HiveID, key []byte) (*hiveClaims, error) {
+	claims := &hiveClaims{}
+	parsed, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("registery: unexpected signing method %v", t.Header["alg"])
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !parsed.Valid {
+		return nil, errors.New("registery: invalid hive token")
+	}
+	if claims.HiveID != id {
+		return nil, fmt.Errorf("registery: token hive id %v does not match %v", claims.HiveID, id)
+	}
+	return claims, nil
+}
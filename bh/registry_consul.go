@@ -0,0 +1,213 @@
+package bh
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// consulKVStore is a KVStore backed by Consul's KV store and sessions,
+// selected by setting HiveConfig.RegType to RegTypeConsul.
+type consulKVStore struct {
+	client *api.Client
+}
+
+func newConsulKVStore(cfg HiveConfig) (KVStore, error) {
+	conf := api.DefaultConfig()
+	if len(cfg.RegAddrs) != 0 {
+		conf.Address = cfg.RegAddrs[0]
+	}
+	if cfg.RegTLS != nil {
+		conf.Scheme = "https"
+		// consul/api's TLSConfig wants CA/cert/key file paths, not a
+		// tls.Config, and there is no supported way to turn an
+		// already-parsed tls.Config (in particular its x509.CertPool) back
+		// into those paths or PEM bytes. So only InsecureSkipVerify carries
+		// over here: operators who need a custom CA or client cert against
+		// Consul must configure it directly on the Consul agent/client
+		// rather than through HiveConfig.RegTLS, which is fully honored
+		// only for the etcd backend (see newEtcdKVStore).
+		conf.TLSConfig = api.TLSConfig{InsecureSkipVerify: cfg.RegTLS.InsecureSkipVerify}
+	}
+	c, err := api.NewClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &consulKVStore{client: c}, nil
+}
+
+func (s *consulKVStore) Put(key string, value []byte, ttl time.Duration) error {
+	_, err := s.client.KV().Put(&api.KVPair{Key: key, Value: value}, nil)
+	return err
+}
+
+// PutWithKeepAlive implements Leaser: key is acquired under a Consul
+// session with the given TTL, and the session is renewed in the background
+// until stopCh is closed, so the entry is removed by Consul itself (per
+// SessionBehaviorDelete) if this hive dies or is partitioned. If the
+// renewal loop gives up before stopCh closes (the session could not be
+// renewed in time), the returned channel is closed so the caller knows the
+// entry is gone.
+func (s *consulKVStore) PutWithKeepAlive(key string, value []byte, ttl time.Duration, stopCh chan struct{}) (<-chan struct{}, error) {
+	entry := &api.SessionEntry{
+		TTL:      ttl.String(),
+		Behavior: api.SessionBehaviorDelete,
+	}
+	id, _, err := s.client.Session().Create(entry, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, _, err := s.client.KV().Acquire(&api.KVPair{Key: key, Value: value, Session: id}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("consulKVStore: could not acquire session lock for %s", key)
+	}
+
+	lost := make(chan struct{})
+	go func() {
+		s.client.Session().RenewPeriodic(entry.TTL, id, nil, stopCh)
+		select {
+		case <-stopCh:
+		default:
+			close(lost)
+		}
+	}()
+	return lost, nil
+}
+
+func (s *consulKVStore) Get(key string) (*KVPair, error) {
+	pair, _, err := s.client.KV().Get(key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		return nil, ErrKeyNotFound
+	}
+	return kvPairFromConsul(pair), nil
+}
+
+func (s *consulKVStore) Delete(key string) error {
+	_, err := s.client.KV().Delete(key, nil)
+	return err
+}
+
+func (s *consulKVStore) Watch(key string, stopCh chan struct{}) (<-chan *KVPair, error) {
+	out := make(chan *KVPair)
+	go func() {
+		defer close(out)
+		var lastIndex uint64
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			pair, meta, err := s.client.KV().Get(key, &api.QueryOptions{
+				WaitIndex: lastIndex,
+				WaitTime:  10 * time.Second,
+			})
+			if err != nil || pair == nil {
+				continue
+			}
+			lastIndex = meta.LastIndex
+			out <- kvPairFromConsul(pair)
+		}
+	}()
+	return out, nil
+}
+
+func (s *consulKVStore) WatchTree(dir string, stopCh chan struct{}) (<-chan []*KVPair, error) {
+	out := make(chan []*KVPair)
+	go func() {
+		defer close(out)
+		var lastIndex uint64
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			pairs, meta, err := s.client.KV().List(dir, &api.QueryOptions{
+				WaitIndex: lastIndex,
+				WaitTime:  10 * time.Second,
+			})
+			if err != nil {
+				continue
+			}
+			lastIndex = meta.LastIndex
+			kvs := make([]*KVPair, len(pairs))
+			for i, p := range pairs {
+				kvs[i] = kvPairFromConsul(p)
+			}
+			out <- kvs
+		}
+	}()
+	return out, nil
+}
+
+func (s *consulKVStore) AtomicPut(key string, value []byte, previous *KVPair, ttl time.Duration) (bool, *KVPair, error) {
+	var modifyIndex uint64
+	if previous != nil {
+		modifyIndex = previous.LastIndex
+	}
+	ok, _, err := s.client.KV().CAS(&api.KVPair{
+		Key:         key,
+		Value:       value,
+		ModifyIndex: modifyIndex,
+	}, nil)
+	if err != nil || !ok {
+		return false, nil, err
+	}
+	pair, err := s.Get(key)
+	return true, pair, err
+}
+
+func (s *consulKVStore) AtomicDelete(key string, previous *KVPair) (bool, error) {
+	var modifyIndex uint64
+	if previous != nil {
+		modifyIndex = previous.LastIndex
+	}
+	ok, _, err := s.client.KV().DeleteCAS(&api.KVPair{
+		Key:         key,
+		ModifyIndex: modifyIndex,
+	}, nil)
+	return ok, err
+}
+
+// consulLock wraps a Consul session-backed lock.
+type consulLock struct {
+	lock *api.Lock
+}
+
+func (s *consulKVStore) NewLock(key string, options *LockOptions) (Locker, error) {
+	opts := &api.LockOptions{Key: key}
+	if options != nil {
+		opts.Value = options.Value
+		if options.TTL > 0 {
+			opts.SessionTTL = options.TTL.String()
+		}
+	}
+	l, err := s.client.LockOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &consulLock{lock: l}, nil
+}
+
+func (l *consulLock) Lock(stopCh chan struct{}) (<-chan struct{}, error) {
+	return l.lock.Lock(stopCh)
+}
+
+func (l *consulLock) Unlock() error {
+	return l.lock.Unlock()
+}
+
+func (s *consulKVStore) Close() {}
+
+func kvPairFromConsul(p *api.KVPair) *KVPair {
+	return &KVPair{Key: p.Key, Value: p.Value, LastIndex: p.ModifyIndex}
+}
@@ -0,0 +1,307 @@
+package bh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// etcdKVStore is the default KVStore, backed by the etcd v3 client. Hive
+// liveness is backed by a lease with a background KeepAlive (see
+// PutWithKeepAlive) and MapSet writes commit as a single Txn (see PutAll),
+// so a dead or partitioned client can no longer leave the registry in a
+// torn state.
+type etcdKVStore struct {
+	client *clientv3.Client
+}
+
+func newEtcdKVStore(cfg HiveConfig) (KVStore, error) {
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints:   cfg.RegAddrs,
+		DialTimeout: 5 * time.Second,
+		TLS:         cfg.RegTLS,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to etcd nodes %v: %v", cfg.RegAddrs, err)
+	}
+	return &etcdKVStore{client: c}, nil
+}
+
+func (s *etcdKVStore) leaseOpts(ttl time.Duration) ([]clientv3.OpOption, error) {
+	if ttl <= 0 {
+		return nil, nil
+	}
+	lease, err := s.client.Grant(context.Background(), int64(ttl/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	return []clientv3.OpOption{clientv3.WithLease(lease.ID)}, nil
+}
+
+func (s *etcdKVStore) Put(key string, value []byte, ttl time.Duration) error {
+	opts, err := s.leaseOpts(ttl)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Put(context.Background(), key, string(value), opts...)
+	return err
+}
+
+// PutWithKeepAlive implements Leaser: key is bound to a lease that is kept
+// alive in the background until stopCh is closed, so a hive entry expires
+// on its own if the process dies or the network partitions. If the
+// keepalive stream breaks before stopCh closes, the returned channel is
+// closed so the caller knows the lease (and the key bound to it) is gone.
+func (s *etcdKVStore) PutWithKeepAlive(key string, value []byte, ttl time.Duration, stopCh chan struct{}) (<-chan struct{}, error) {
+	lease, err := s.client.Grant(context.Background(), int64(ttl/time.Second))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.client.Put(context.Background(), key, string(value), clientv3.WithLease(lease.ID)); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	keepAliveCh, err := s.client.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	lost := make(chan struct{})
+	go func() {
+		defer cancel()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case _, ok := <-keepAliveCh:
+				if !ok {
+					close(lost)
+					return
+				}
+			}
+		}
+	}()
+	return lost, nil
+}
+
+// PutAll implements Transactor: every pair is written in a single Txn so
+// callers never observe some keys moved and others not.
+func (s *etcdKVStore) PutAll(kvs []KVPair, ttl time.Duration) error {
+	opts, err := s.leaseOpts(ttl)
+	if err != nil {
+		return err
+	}
+	ops := make([]clientv3.Op, len(kvs))
+	for i, kv := range kvs {
+		ops[i] = clientv3.OpPut(kv.Key, string(kv.Value), opts...)
+	}
+	_, err = s.client.Txn(context.Background()).Then(ops...).Commit()
+	return err
+}
+
+func (s *etcdKVStore) Get(key string) (*KVPair, error) {
+	res, err := s.client.Get(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Kvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return kvPairFromKV(res.Kvs[0]), nil
+}
+
+func (s *etcdKVStore) Delete(key string) error {
+	_, err := s.client.Delete(context.Background(), key)
+	return err
+}
+
+func (s *etcdKVStore) Watch(key string, stopCh chan struct{}) (<-chan *KVPair, error) {
+	out := make(chan *KVPair)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	wch := s.client.Watch(ctx, key)
+	go func() {
+		defer close(out)
+		for res := range wch {
+			for _, ev := range res.Events {
+				out <- kvPairFromKV(ev.Kv)
+			}
+		}
+	}()
+	return out, nil
+}
+
+// WatchTree uses a resumable revision so a temporary disconnect from the
+// registry re-subscribes from where it left off rather than silently
+// missing HiveJoined/HiveLeft events in between. The initial snapshot is
+// fetched before WatchTree returns, so a registry that is unreachable at
+// subscribe time is reported as an error to the caller instead of only
+// showing up later as the returned channel closing.
+func (s *etcdKVStore) WatchTree(dir string, stopCh chan struct{}) (<-chan []*KVPair, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	get := func() ([]*KVPair, int64, error) {
+		res, err := s.client.Get(ctx, dir, clientv3.WithPrefix())
+		if err != nil {
+			return nil, 0, err
+		}
+		pairs := make([]*KVPair, len(res.Kvs))
+		for i, kv := range res.Kvs {
+			pairs[i] = kvPairFromKV(kv)
+		}
+		return pairs, res.Header.Revision, nil
+	}
+
+	pairs, rev, err := get()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	out := make(chan []*KVPair)
+	go func() {
+		defer close(out)
+		out <- pairs
+		wch := s.client.Watch(ctx, dir, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+		for range wch {
+			p, _, err := get()
+			if err != nil {
+				return
+			}
+			out <- p
+		}
+	}()
+	return out, nil
+}
+
+func kvPairFromKV(kv *mvccpb.KeyValue) *KVPair {
+	return &KVPair{Key: string(kv.Key), Value: kv.Value, LastIndex: uint64(kv.ModRevision)}
+}
+
+func (s *etcdKVStore) AtomicPut(key string, value []byte, previous *KVPair, ttl time.Duration) (bool, *KVPair, error) {
+	opts, err := s.leaseOpts(ttl)
+	if err != nil {
+		return false, nil, err
+	}
+
+	var cmp clientv3.Cmp
+	if previous == nil {
+		cmp = clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+	} else {
+		cmp = clientv3.Compare(clientv3.ModRevision(key), "=", int64(previous.LastIndex))
+	}
+
+	res, err := s.client.Txn(context.Background()).
+		If(cmp).
+		Then(clientv3.OpPut(key, string(value), opts...)).
+		Commit()
+	if err != nil {
+		return false, nil, err
+	}
+	if !res.Succeeded {
+		return false, nil, nil
+	}
+
+	pair, err := s.Get(key)
+	return true, pair, err
+}
+
+func (s *etcdKVStore) AtomicDelete(key string, previous *KVPair) (bool, error) {
+	if previous == nil {
+		return false, errors.New("etcdKVStore: AtomicDelete requires a previous KVPair")
+	}
+
+	res, err := s.client.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", int64(previous.LastIndex))).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return res.Succeeded, nil
+}
+
+// etcdLock implements Locker with a concurrency.Mutex, so lock ownership is
+// tied to an etcd session lease instead of the old Create-then-Watch retry
+// loop: the lock is released automatically if the holder's session expires.
+type etcdLock struct {
+	client *clientv3.Client
+	value  []byte
+	sess   *concurrency.Session
+	mu     *concurrency.Mutex
+}
+
+func (s *etcdKVStore) NewLock(key string, options *LockOptions) (Locker, error) {
+	var v []byte
+	var sessOpts []concurrency.SessionOption
+	if options != nil {
+		v = options.Value
+		if options.TTL > 0 {
+			sessOpts = append(sessOpts, concurrency.WithTTL(int(options.TTL/time.Second)))
+		}
+	}
+
+	sess, err := concurrency.NewSession(s.client, sessOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdLock{
+		client: s.client,
+		value:  v,
+		sess:   sess,
+		mu:     concurrency.NewMutex(sess, "/"+key),
+	}, nil
+}
+
+func (l *etcdLock) Lock(stopCh chan struct{}) (<-chan struct{}, error) {
+	ctx := context.Background()
+	if stopCh != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		go func() {
+			<-stopCh
+			cancel()
+		}()
+	}
+
+	if err := l.mu.Lock(ctx); err != nil {
+		l.sess.Close()
+		return nil, err
+	}
+
+	if len(l.value) != 0 {
+		l.client.Put(context.Background(), l.mu.Key(), string(l.value), clientv3.WithLease(l.sess.Lease()))
+	}
+
+	lost := make(chan struct{})
+	go func() {
+		<-l.sess.Done()
+		close(lost)
+	}()
+	return lost, nil
+}
+
+func (l *etcdLock) Unlock() error {
+	defer l.sess.Close()
+	return l.mu.Unlock(context.Background())
+}
+
+func (s *etcdKVStore) Close() {
+	s.client.Close()
+}
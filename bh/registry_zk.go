@@ -0,0 +1,245 @@
+package bh
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// zkKVStore is a KVStore backed by ZooKeeper, selected by setting
+// HiveConfig.RegType to RegTypeZk. Plain Put has no notion of per-key TTL,
+// so it ignores ttl and relies on the caller re-Put-ing to refresh liveness
+// (as registery's updateTTL does for backends without a Leaser); hive
+// entries instead go through PutWithKeepAlive, which ties liveness to an
+// ephemeral znode.
+type zkKVStore struct {
+	conn *zk.Conn
+}
+
+func newZkKVStore(cfg HiveConfig) (KVStore, error) {
+	// TODO(soheil): samuel/go-zookeeper has no TLS support; cfg.RegTLS is
+	// ignored here until we pick a client that can dial zk over TLS.
+	// Operators on RegTypeZk therefore always talk to ZooKeeper in
+	// plaintext: HiveConfig.RegTLS is fully honored only for the etcd
+	// backend (see newEtcdKVStore), and partially for Consul (see
+	// newConsulKVStore).
+	conn, _, err := zk.Connect(cfg.RegAddrs, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &zkKVStore{conn: conn}, nil
+}
+
+func (s *zkKVStore) createParents(key string) error {
+	parts := splitZkPath(key)
+	path := ""
+	for _, p := range parts[:len(parts)-1] {
+		path += "/" + p
+		if exists, _, err := s.conn.Exists(path); err != nil {
+			return err
+		} else if !exists {
+			if _, err := s.conn.Create(path, nil, 0, zk.WorldACL(zk.PermAll)); err != nil && err != zk.ErrNodeExists {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func splitZkPath(key string) []string {
+	var parts []string
+	for _, p := range zkSplit(key, '/') {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+func zkSplit(s string, sep byte) []string {
+	var out []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == sep {
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	out = append(out, s[start:])
+	return out
+}
+
+func (s *zkKVStore) Put(key string, value []byte, ttl time.Duration) error {
+	if err := s.createParents(key); err != nil {
+		return err
+	}
+	_, err := s.conn.Set("/"+key, value, -1)
+	if err == zk.ErrNoNode {
+		_, err = s.conn.Create("/"+key, value, 0, zk.WorldACL(zk.PermAll))
+	}
+	return err
+}
+
+// PutWithKeepAlive implements Leaser: key is created as an ephemeral znode,
+// so ZooKeeper itself removes it as soon as this connection's session ends
+// (the hive dies or is partitioned), without needing a renewal loop the way
+// a lease-based backend does. The returned channel is closed if the znode
+// disappears for any reason other than stopCh closing it, so the caller
+// knows the entry is gone.
+func (s *zkKVStore) PutWithKeepAlive(key string, value []byte, ttl time.Duration, stopCh chan struct{}) (<-chan struct{}, error) {
+	if err := s.createParents(key); err != nil {
+		return nil, err
+	}
+	if _, err := s.conn.Create("/"+key, value, zk.FlagEphemeral, zk.WorldACL(zk.PermAll)); err != nil {
+		return nil, err
+	}
+
+	lost := make(chan struct{})
+	go func() {
+		for {
+			exists, _, eventCh, err := s.conn.ExistsW("/" + key)
+			if err != nil || !exists {
+				close(lost)
+				return
+			}
+			select {
+			case <-stopCh:
+				s.conn.Delete("/"+key, -1)
+				return
+			case <-eventCh:
+			}
+		}
+	}()
+	return lost, nil
+}
+
+func (s *zkKVStore) Get(key string) (*KVPair, error) {
+	v, stat, err := s.conn.Get("/" + key)
+	if err == zk.ErrNoNode {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &KVPair{Key: key, Value: v, LastIndex: uint64(stat.Version)}, nil
+}
+
+func (s *zkKVStore) Delete(key string) error {
+	return s.conn.Delete("/"+key, -1)
+}
+
+func (s *zkKVStore) Watch(key string, stopCh chan struct{}) (<-chan *KVPair, error) {
+	out := make(chan *KVPair)
+	go func() {
+		defer close(out)
+		for {
+			_, _, eventCh, err := s.conn.GetW("/" + key)
+			if err != nil {
+				return
+			}
+			select {
+			case <-stopCh:
+				return
+			case <-eventCh:
+			}
+			pair, err := s.Get(key)
+			if err != nil {
+				continue
+			}
+			out <- pair
+		}
+	}()
+	return out, nil
+}
+
+// WatchTree subscribes to dir's children before returning, so a ZooKeeper
+// connection that is down at subscribe time is reported as an error to the
+// caller instead of only showing up later as the returned channel closing.
+func (s *zkKVStore) WatchTree(dir string, stopCh chan struct{}) (<-chan []*KVPair, error) {
+	// ZooKeeper rejects paths ending in "/", which is how hivePath() ends.
+	dir = strings.TrimSuffix(dir, "/")
+	children, _, eventCh, err := s.conn.ChildrenW("/" + dir)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan []*KVPair)
+	go func() {
+		defer close(out)
+		for {
+			pairs := make([]*KVPair, 0, len(children))
+			for _, c := range children {
+				if p, err := s.Get(dir + "/" + c); err == nil {
+					pairs = append(pairs, p)
+				}
+			}
+			out <- pairs
+
+			select {
+			case <-stopCh:
+				return
+			case <-eventCh:
+			}
+
+			children, _, eventCh, err = s.conn.ChildrenW("/" + dir)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (s *zkKVStore) AtomicPut(key string, value []byte, previous *KVPair, ttl time.Duration) (bool, *KVPair, error) {
+	if previous == nil {
+		if err := s.createParents(key); err != nil {
+			return false, nil, err
+		}
+		if _, err := s.conn.Create("/"+key, value, 0, zk.WorldACL(zk.PermAll)); err != nil {
+			return false, nil, err
+		}
+	} else if _, err := s.conn.Set("/"+key, value, int32(previous.LastIndex)); err != nil {
+		return false, nil, err
+	}
+	pair, err := s.Get(key)
+	return true, pair, err
+}
+
+func (s *zkKVStore) AtomicDelete(key string, previous *KVPair) (bool, error) {
+	if previous == nil {
+		return false, errors.New("zkKVStore: AtomicDelete requires a previous KVPair")
+	}
+	if err := s.conn.Delete("/"+key, int32(previous.LastIndex)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// zkLock wraps ZooKeeper's ephemeral-sequential-node lock recipe. NewLock
+// ignores LockOptions, so no Value is stored with the lock and expiry
+// follows the ZooKeeper session. Lock ignores stopCh and blocks until the
+// lock is acquired, and the channel it returns is never closed.
+type zkLock struct {
+	lock *zk.Lock
+}
+
+func (s *zkKVStore) NewLock(key string, options *LockOptions) (Locker, error) {
+	return &zkLock{lock: zk.NewLock(s.conn, "/"+key, zk.WorldACL(zk.PermAll))}, nil
+}
+
+func (l *zkLock) Lock(stopCh chan struct{}) (<-chan struct{}, error) {
+	if err := l.lock.Lock(); err != nil {
+		return nil, err
+	}
+	return make(chan struct{}), nil
+}
+
+func (l *zkLock) Unlock() error {
+	return l.lock.Unlock()
+}
+
+func (s *zkKVStore) Close() {
+	s.conn.Close()
+}